@@ -0,0 +1,161 @@
+package tailscalesd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// LabelMetaSource identifies which registered Source produced a target, in
+// an aggregate of multiple tailnets and/or APIs.
+const LabelMetaSource = "__meta_tailscale_source"
+
+// maxConcurrentSources bounds how many Sources an AggregateHandler queries
+// concurrently.
+const maxConcurrentSources = 8
+
+// Source is one named, independently configured Client to discover targets
+// from: one tailnet, one API flavor (public or local), or both.
+type Source struct {
+	Name     string
+	Client   Client
+	Pipeline Pipeline
+	Ports    *PortsConfig
+}
+
+// AggregateHandler merges targets discovered from multiple Sources into a
+// single Prometheus HTTP SD response, tagging each target with
+// LabelMetaSource and deduplicating by node key, tag and targets. A Source whose Client
+// returns ErrStaleResults does not fail the aggregate response; its
+// (possibly stale) targets are still served.
+type AggregateHandler struct {
+	sources []Source
+}
+
+// NewAggregateHandler returns an AggregateHandler serving the merged,
+// deduplicated targets of sources.
+func NewAggregateHandler(sources []Source) *AggregateHandler {
+	return &AggregateHandler{sources: sources}
+}
+
+// aggregateSourceLabel is the source label AggregateHandler uses for its own
+// scrape-request metric; individual Sources are metered under their own
+// names by discoverSource.
+const aggregateSourceLabel = "aggregate"
+
+func (a *AggregateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scrapeRequestsTotal.WithLabelValues(aggregateSourceLabel).Inc()
+	targets := a.Discover(r.Context())
+	targetsReturned.WithLabelValues(aggregateSourceLabel).Set(float64(len(targets)))
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(targets); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed encoding targets to JSON: %v", err)
+		fmt.Fprintf(w, "Failed encoding targets to JSON: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if _, err := io.Copy(w, &buf); err != nil {
+		// The transaction with the client is already started, so there's nothing
+		// graceful to do here. Log any errors for troubleshooting later.
+		log.Printf("Failed sending JSON payload to the client: %v", err)
+	}
+}
+
+type sourceResult struct {
+	name    string
+	targets []TargetDescriptor
+	err     error
+}
+
+// Discover fans out Devices calls across a.sources with a bounded worker
+// pool, applies each Source's own Pipeline and Ports, and merges the
+// results, deduplicating by node key, tag and targets. A failing Source is logged and
+// excluded rather than aborting the whole response. Exported so file_sd
+// output can reuse the same merged view without an HTTP request/response
+// cycle.
+func (a *AggregateHandler) Discover(ctx context.Context) []TargetDescriptor {
+	results := make(chan sourceResult, len(a.sources))
+	sem := make(chan struct{}, maxConcurrentSources)
+	var wg sync.WaitGroup
+	for _, src := range a.sources {
+		wg.Add(1)
+		go func(src Source) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results <- discoverSource(ctx, src)
+		}(src)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	seen := make(map[string]bool)
+	var merged []TargetDescriptor
+	for res := range results {
+		if res.err != nil {
+			log.Printf("Source %q failed, excluding it from this response: %v", res.name, res.err)
+			continue
+		}
+		for _, t := range res.targets {
+			// Keyed on (node key, tag, targets) rather than node key alone,
+			// since translate emits one TargetDescriptor per ACL tag and per
+			// port for a single device; deduping on node key alone would
+			// collapse those rows down to one instead of only deduping the
+			// same device reported by more than one Source.
+			if key := t.Labels[LabelMetaDeviceNodeKey]; key != "" {
+				key += "\x00" + t.Labels[LabelMetaDeviceTag] + "\x00" + strings.Join(t.Targets, ",")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			merged = append(merged, t)
+		}
+	}
+	return merged
+}
+
+func discoverSource(ctx context.Context, src Source) sourceResult {
+	// Upstream-level metrics are recorded by a CachingClient, if src.Client
+	// is wrapped in one.
+	devices, err := src.Client.Devices(ctx)
+	if err != nil && err != ErrStaleResults {
+		return sourceResult{name: src.Name, err: err}
+	}
+	if err == ErrStaleResults {
+		log.Printf("Source %q: serving potentially stale results", src.Name)
+	}
+
+	raw, err := translate(devices, src.Ports)
+	if err != nil {
+		return sourceResult{name: src.Name, err: err}
+	}
+
+	targets := make([]TargetDescriptor, 0, len(raw))
+	for _, t := range raw {
+		kept, ok := src.Pipeline.Run(t)
+		if !ok {
+			continue
+		}
+		labels := make(map[string]string, len(kept.Labels)+1)
+		for k, v := range kept.Labels {
+			labels[k] = v
+		}
+		labels[LabelMetaSource] = src.Name
+		kept.Labels = labels
+		targets = append(targets, kept)
+	}
+	targetsReturned.WithLabelValues(src.Name).Set(float64(len(targets)))
+	return sourceResult{name: src.Name, targets: targets}
+}
@@ -0,0 +1,65 @@
+package tailscalesd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long a CachingClient will keep serving its last
+// successful result after the wrapped Client starts failing.
+const DefaultCacheTTL = 5 * time.Minute
+
+// CachingClient wraps a Client, serving its last successful result (along
+// with ErrStaleResults) when the wrapped Client's Devices call fails, rather
+// than propagating the error. This lets a flaky or rate-limited upstream
+// keep Prometheus discovery working instead of causing scrape gaps.
+type CachingClient struct {
+	source string
+	next   Client
+	ttl    time.Duration
+
+	mu          sync.Mutex
+	cached      []Device
+	lastSuccess time.Time
+}
+
+// NewCachingClient wraps next, serving cached results for up to ttl after
+// next starts failing. source labels this Client's metrics.
+func NewCachingClient(source string, next Client, ttl time.Duration) *CachingClient {
+	return &CachingClient{source: source, next: next, ttl: ttl}
+}
+
+// Devices implements Client.
+func (c *CachingClient) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := instrumentedDevices(ctx, c.source, c.next)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.cached = devices
+		c.lastSuccess = time.Now()
+		cacheAgeSeconds.WithLabelValues(c.source).Set(0)
+		return devices, nil
+	}
+
+	if c.lastSuccess.IsZero() {
+		// Nothing cached yet; nothing to fall back to.
+		upstreamRequestsTotal.WithLabelValues(c.source, "error").Inc()
+		return nil, err
+	}
+	age := time.Since(c.lastSuccess)
+	cacheAgeSeconds.WithLabelValues(c.source).Set(age.Seconds())
+	if age > c.ttl {
+		upstreamRequestsTotal.WithLabelValues(c.source, "error").Inc()
+		return nil, err
+	}
+
+	// instrumentedDevices only records "ok" calls; CachingClient is the only
+	// place that knows a failed call is actually being served as stale, so
+	// it records the "stale" outcome itself here, exactly once.
+	upstreamRequestsTotal.WithLabelValues(c.source, "stale").Inc()
+	staleResponsesTotal.WithLabelValues(c.source).Inc()
+	return c.cached, ErrStaleResults
+}
@@ -0,0 +1,148 @@
+package tailscalesd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrStaleResults is returned by a Client's Devices method when it cannot
+// refresh its view of the Tailnet, but has previously cached results which
+// may still be served.
+var ErrStaleResults = errors.New("tailscalesd: stale results")
+
+// Client describes anything capable of reporting the Devices on a Tailnet.
+type Client interface {
+	// Devices retrieves the current set of Devices known to the Client. If a
+	// Client cannot reach its upstream but has cached results from a prior
+	// call, it may return those along with ErrStaleResults instead of an
+	// error which aborts discovery entirely.
+	Devices(ctx context.Context) ([]Device, error)
+}
+
+// Device as reported by either the Tailscale public API or the local API.
+// Not every field is populated by every Client; see the comments on each
+// Label in this package for details on which API(s) report which fields.
+type Device struct {
+	// API is the host which provided the details about this device. Set by
+	// the Client, not by the upstream API response.
+	API string `json:"-"`
+
+	// Tailnet is the name of the Tailnet this Device belongs to. Set by the
+	// Client, not by the upstream API response.
+	Tailnet string `json:"-"`
+
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Hostname      string   `json:"hostname"`
+	ClientVersion string   `json:"clientVersion"`
+	OS            string   `json:"os"`
+	Tags          []string `json:"tags,omitempty"`
+	Addresses     []string `json:"addresses"`
+	Authorized    bool     `json:"authorized"`
+
+	// User is the login name of the user who registered this device.
+	User string `json:"user"`
+
+	// Created is when the device was first registered with the Tailnet.
+	Created apiTime `json:"created"`
+
+	// LastSeen is when the device last communicated with the control plane.
+	LastSeen apiTime `json:"lastSeen"`
+
+	// Expires is when the device's node key expires. Zero if the device has
+	// no expiry, e.g. because KeyExpiryDisabled is true.
+	Expires apiTime `json:"expires"`
+
+	// KeyExpiryDisabled is whether this device's node key is exempt from
+	// expiry.
+	KeyExpiryDisabled bool `json:"keyExpiryDisabled"`
+
+	// UpdateAvailable is whether a newer Tailscale client version is
+	// available for this device.
+	UpdateAvailable bool `json:"updateAvailable"`
+
+	// IsExternal is whether this device belongs to a shared-in node from
+	// another Tailnet rather than this one.
+	IsExternal bool `json:"isExternal"`
+
+	// MachineKey identifies the device's current Noise session.
+	MachineKey string `json:"machineKey"`
+
+	// NodeKey identifies the device's Wireguard key.
+	NodeKey string `json:"nodeKey"`
+
+	// BlocksIncomingConnections is whether the device is configured to
+	// refuse all incoming connections, per its Tailscale client settings.
+	BlocksIncomingConnections bool `json:"blocksIncomingConnections"`
+
+	// ClientConnectivity reports the device's most recently observed
+	// network path information, as known to the control plane.
+	ClientConnectivity ClientConnectivity `json:"clientConnectivity"`
+}
+
+// ClientConnectivity mirrors the subset of the Tailscale API's
+// ClientConnectivity object this package cares about: which DERP region the
+// device prefers, how reachable it is, and whether it can negotiate direct
+// connections.
+type ClientConnectivity struct {
+	// Endpoints are the device's most recently reported possible
+	// address:port endpoints for direct connections.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// MappingVariesByDestIP is whether the device's NAT produces different
+	// external mappings depending on the destination, which makes direct
+	// connections harder to establish. It is opt.Bool's tri-state in
+	// disguise: "true", "false", or "" when the control plane hasn't
+	// reported it.
+	MappingVariesByDestIP optBool `json:"mappingVariesByDestIP,omitempty"`
+
+	// DERP is the address of the DERP server the device prefers, in
+	// "region-id-region-code" form, e.g. "162-lhr". Only reported by the
+	// local API; the public API reports preference via DERPLatency instead.
+	DERP string `json:"derp,omitempty"`
+
+	// DERPLatency maps DERP region names to the device's most recent
+	// connectivity sample for that region, as reported by the public API.
+	DERPLatency map[string]DERPRegionLatency `json:"latency,omitempty"`
+}
+
+// DERPRegionLatency is a device's connectivity sample for a single DERP
+// region: whether it's the device's preferred region, and the
+// last-measured round-trip latency to it, in milliseconds.
+type DERPRegionLatency struct {
+	Preferred           bool    `json:"preferred"`
+	LatencyMilliseconds float64 `json:"latencyMs"`
+}
+
+// optBool is Tailscale's opt.Bool: a tri-state boolean encoded over the
+// wire as the JSON string "true", "false", or "" (not reported), rather
+// than a JSON boolean.
+type optBool string
+
+// apiTime decodes a timestamp as reported by the Tailscale public API: an
+// RFC3339 string, or "" when the field doesn't apply, e.g. Device.Expires
+// for a device with KeyExpiryDisabled. It embeds time.Time, which stays at
+// its zero value when decoded from "".
+type apiTime struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *apiTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
@@ -0,0 +1,211 @@
+// Command tailscalesd serves Prometheus Service Discovery for Tailscale over
+// HTTP.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/elsbrock/tailscalesd"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tailnetList collects repeated -tailnet flags, so tailscalesd can aggregate
+// targets from more than one tailnet in a single process.
+type tailnetList []string
+
+func (t *tailnetList) String() string { return strings.Join(*t, ",") }
+func (t *tailnetList) Set(v string) error {
+	*t = append(*t, v)
+	return nil
+}
+
+var (
+	listen = flag.String("address", ":9242", "Address on which to serve Tailscale Service Discovery.")
+
+	tailnets tailnetList
+	local    = flag.Bool("local", false, "Also discover devices using the local machine's Tailscale client, registered as source \"local\".")
+
+	apiKeyFile = flag.String("api-key-file", "", "Path to a file containing a Tailscale API key, shared by every -tailnet.")
+
+	oauthClientIDFile     = flag.String("oauth-client-id-file", "", "Path to a file containing a Tailscale OAuth2 client ID.")
+	oauthClientSecretFile = flag.String("oauth-client-secret-file", "", "Path to a file containing a Tailscale OAuth2 client secret.")
+	oauthScopes           = flag.String("oauth-scopes", "devices:core:read", "Comma-separated list of OAuth2 scopes to request.")
+
+	configFile = flag.String("config", "", "Path to a YAML config file describing the target filter/relabel pipeline and ports. Reloaded on SIGHUP. Defaults to tailscalesd's built-in pipeline, applied to every source.")
+
+	fileSDPath     = flag.String("file-sd-path", "", "If set, also (or instead, with -file-sd-once) periodically write the aggregated targets to this path as file_sd_configs JSON.")
+	fileSDInterval = flag.Duration("file-sd-interval", time.Minute, "How often to rewrite -file-sd-path.")
+	fileSDJitter   = flag.Duration("file-sd-jitter", 5*time.Second, "Random jitter added to -file-sd-interval on each poll.")
+	fileSDOnce     = flag.Bool("file-sd-once", false, "Write -file-sd-path once and exit, instead of serving HTTP. For running tailscalesd as a cron job.")
+)
+
+func init() {
+	flag.Var(&tailnets, "tailnet", "Name of a Tailnet to discover devices in, registered as a source of that name. Repeatable to aggregate multiple tailnets.")
+}
+
+func readTrimmedFile(path string) string {
+	if path == "" {
+		return ""
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed reading %q: %v", path, err)
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+func publicClient(tailnet string) tailscalesd.Client {
+	if clientID := readTrimmedFile(*oauthClientIDFile); clientID != "" {
+		clientSecret := readTrimmedFile(*oauthClientSecretFile)
+		scopes := strings.Split(*oauthScopes, ",")
+		return tailscalesd.NewOAuthAPI(clientID, clientSecret, tailnet, scopes)
+	}
+	return tailscalesd.NewAPIClient(tailnet, readTrimmedFile(*apiKeyFile))
+}
+
+// sources returns the name of one source per -tailnet, plus "local" if
+// -local was given. At least one must be configured.
+func sources() []string {
+	names := append([]string{}, tailnets...)
+	if *local {
+		names = append(names, "local")
+	}
+	if len(names) == 0 {
+		log.Fatal("at least one of -tailnet or -local is required")
+	}
+	return names
+}
+
+func clientFor(name string) tailscalesd.Client {
+	var c tailscalesd.Client
+	if name == "local" && *local {
+		c = tailscalesd.NewLocalClient()
+	} else {
+		c = publicClient(name)
+	}
+	return tailscalesd.NewCachingClient(name, c, tailscalesd.DefaultCacheTTL)
+}
+
+// pipelineAndPorts loads *configFile, if set, returning tailscalesd's
+// historical default Pipeline and nil Ports otherwise.
+func pipelineAndPorts() (tailscalesd.Pipeline, *tailscalesd.PortsConfig, error) {
+	if *configFile == "" {
+		return tailscalesd.DefaultPipeline, nil, nil
+	}
+	cfg, err := tailscalesd.LoadConfig(*configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pipeline, err := cfg.Pipeline()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pipeline, cfg.Ports, nil
+}
+
+// aggregateProxy forwards to a hot-swappable *tailscalesd.AggregateHandler,
+// so it can be rebuilt wholesale on a config reload without re-registering
+// it with the mux.
+type aggregateProxy struct {
+	handler atomic.Value
+}
+
+func (p *aggregateProxy) set(h *tailscalesd.AggregateHandler) { p.handler.Store(h) }
+
+func (p *aggregateProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.Load().(*tailscalesd.AggregateHandler).ServeHTTP(w, r)
+}
+
+// Discover implements tailscalesd.DiscoverFunc, always against the current
+// (possibly just-reloaded) aggregate handler.
+func (p *aggregateProxy) Discover(ctx context.Context) []tailscalesd.TargetDescriptor {
+	return p.handler.Load().(*tailscalesd.AggregateHandler).Discover(ctx)
+}
+
+func main() {
+	flag.Parse()
+	names := sources()
+
+	perSource := make([]*tailscalesd.DiscoveryHandler, len(names))
+	aggregate := &aggregateProxy{}
+
+	reload := func() error {
+		pipeline, ports, err := pipelineAndPorts()
+		if err != nil {
+			return err
+		}
+		srcs := make([]tailscalesd.Source, len(names))
+		for i, name := range names {
+			if perSource[i] == nil {
+				perSource[i] = tailscalesd.Export(name, clientFor(name), nil)
+			}
+			perSource[i].SetPipeline(pipeline)
+			perSource[i].SetPorts(ports)
+			srcs[i] = tailscalesd.Source{
+				Name:     name,
+				Client:   perSource[i].Client(),
+				Pipeline: pipeline,
+				Ports:    ports,
+			}
+		}
+		aggregate.set(tailscalesd.NewAggregateHandler(srcs))
+		return nil
+	}
+	if err := reload(); err != nil {
+		log.Fatalf("Failed loading config: %v", err)
+	}
+
+	if *fileSDPath != "" {
+		writer := &tailscalesd.FileWriter{
+			Path:     *fileSDPath,
+			Source:   "file_sd",
+			Discover: aggregate.Discover,
+			Interval: *fileSDInterval,
+			Jitter:   *fileSDJitter,
+		}
+		if *fileSDOnce {
+			if err := writer.WriteOnce(context.Background()); err != nil {
+				log.Fatalf("Failed writing %q: %v", *fileSDPath, err)
+			}
+			return
+		}
+		go func() {
+			if err := writer.Run(context.Background()); err != nil {
+				log.Printf("file_sd writer for %q stopped: %v", *fileSDPath, err)
+			}
+		}()
+	}
+
+	for i, name := range names {
+		http.Handle(fmt.Sprintf("/%s/targets", name), perSource[i])
+	}
+	http.Handle("/targets", aggregate)
+	http.Handle("/metrics", promhttp.Handler())
+
+	if *configFile != "" {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				if err := reload(); err != nil {
+					log.Printf("Failed reloading config %q, keeping previous settings: %v", *configFile, err)
+					continue
+				}
+				log.Printf("Reloaded config %q", *configFile)
+			}
+		}()
+	}
+
+	log.Printf("Serving Tailscale Service Discovery on %q", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,312 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Stage filters or rewrites a single TargetDescriptor produced by translate.
+// It returns the (possibly modified) TargetDescriptor and whether it should
+// be kept; ok being false drops the target from the pipeline entirely.
+type Stage func(TargetDescriptor) (td TargetDescriptor, ok bool)
+
+// Pipeline is an ordered sequence of Stages run against every
+// TargetDescriptor discovered by a Client. A target is dropped as soon as
+// any Stage rejects it.
+type Pipeline []Stage
+
+// Run applies every Stage in p to td in order, short-circuiting on the first
+// Stage that drops it.
+func (p Pipeline) Run(td TargetDescriptor) (TargetDescriptor, bool) {
+	ok := true
+	for _, stage := range p {
+		td, ok = stage(td)
+		if !ok {
+			return TargetDescriptor{}, false
+		}
+	}
+	return td, true
+}
+
+// DefaultPipeline reproduces tailscalesd's historical, hardcoded behavior:
+// strip empty labels and keep only IPv4 targets. It's used when no config
+// file is supplied.
+var DefaultPipeline = Pipeline{stripEmptyLabels, ipv4Only}
+
+// Config is the top-level schema for a tailscalesd config file. It describes
+// the target filter/relabel pipeline (see Stages) and, optionally, port
+// expansion (see Ports).
+//
+// Example:
+//
+//	stages:
+//	  - type: drop_unauthorized
+//	  - type: keep_os
+//	    os: [linux]
+//	  - type: drop_stale_last_seen
+//	    after: 24h
+//	  - type: relabel
+//	    source_labels: ["__meta_tailscale_device_tag"]
+//	    regex: "tag:([a-z-]+)"
+//	    target_label: role
+//	    action: replace
+//	    replacement: "${1}"
+type Config struct {
+	Stages []StageConfig `yaml:"stages"`
+
+	// Ports, if set, expands discovered devices into host:port targets. See
+	// PortsConfig.
+	Ports *PortsConfig `yaml:"ports,omitempty"`
+}
+
+// StageConfig describes one Stage in a Pipeline. Type selects which fields
+// below are relevant; unused fields are ignored.
+type StageConfig struct {
+	// Type names the Stage: one of keep_tag, drop_tag, keep_os,
+	// drop_unauthorized, drop_external, drop_expired, drop_stale_last_seen,
+	// ipv4_only, ipv6_only, strip_empty_labels, or relabel.
+	Type string `yaml:"type"`
+
+	// Tag is the ACL tag to match. Used by keep_tag and drop_tag.
+	Tag string `yaml:"tag,omitempty"`
+
+	// OS lists the operating systems to match, e.g. "linux", "darwin". Used
+	// by keep_os.
+	OS []string `yaml:"os,omitempty"`
+
+	// After is a target's maximum allowed age since it was last seen. Used
+	// by drop_stale_last_seen.
+	After time.Duration `yaml:"after,omitempty"`
+
+	// The following fields configure a Prometheus-style relabel_config and
+	// are used only when Type is "relabel".
+
+	// SourceLabels are joined with Separator and matched against Regex.
+	SourceLabels []string `yaml:"source_labels,omitempty"`
+	// Separator joins SourceLabels before matching. Defaults to ";".
+	Separator string `yaml:"separator,omitempty"`
+	// Regex is matched against the joined SourceLabels. Defaults to "(.*)".
+	Regex string `yaml:"regex,omitempty"`
+	// TargetLabel receives Replacement when Action is "replace".
+	TargetLabel string `yaml:"target_label,omitempty"`
+	// Replacement may reference regex capture groups, e.g. "${1}".
+	Replacement string `yaml:"replacement,omitempty"`
+	// Action is one of replace, keep, drop, or labelmap. Defaults to
+	// "replace".
+	Action string `yaml:"action,omitempty"`
+}
+
+// LoadConfig reads and parses a tailscalesd config file at path.
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading config %q: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed parsing config %q: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Pipeline builds the Pipeline described by c. An empty Config produces an
+// empty (no-op) Pipeline; callers wanting tailscalesd's historical defaults
+// should fall back to DefaultPipeline themselves.
+func (c *Config) Pipeline() (Pipeline, error) {
+	pipeline := make(Pipeline, 0, len(c.Stages))
+	for i, sc := range c.Stages {
+		stage, err := buildStage(sc)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %w", i, sc.Type, err)
+		}
+		pipeline = append(pipeline, stage)
+	}
+	return pipeline, nil
+}
+
+func buildStage(sc StageConfig) (Stage, error) {
+	switch sc.Type {
+	case "keep_tag":
+		return keepTag(sc.Tag), nil
+	case "drop_tag":
+		return dropTag(sc.Tag), nil
+	case "keep_os":
+		return keepOS(sc.OS), nil
+	case "drop_unauthorized":
+		return dropUnauthorized, nil
+	case "drop_external":
+		return dropExternal, nil
+	case "drop_expired":
+		return dropExpired, nil
+	case "drop_stale_last_seen":
+		return dropStaleLastSeen(sc.After), nil
+	case "ipv4_only":
+		return ipv4Only, nil
+	case "ipv6_only":
+		return ipv6Only, nil
+	case "strip_empty_labels":
+		return stripEmptyLabels, nil
+	case "relabel":
+		return relabel(sc)
+	default:
+		return nil, fmt.Errorf("unknown stage type %q", sc.Type)
+	}
+}
+
+func keepTag(tag string) Stage {
+	return func(td TargetDescriptor) (TargetDescriptor, bool) {
+		return td, td.Labels[LabelMetaDeviceTag] == tag
+	}
+}
+
+func dropTag(tag string) Stage {
+	return func(td TargetDescriptor) (TargetDescriptor, bool) {
+		return td, td.Labels[LabelMetaDeviceTag] != tag
+	}
+}
+
+func keepOS(oses []string) Stage {
+	return func(td TargetDescriptor) (TargetDescriptor, bool) {
+		os := td.Labels[LabelMetaDeviceOS]
+		for _, want := range oses {
+			if os == want {
+				return td, true
+			}
+		}
+		return td, false
+	}
+}
+
+func dropUnauthorized(td TargetDescriptor) (TargetDescriptor, bool) {
+	return td, td.Labels[LabelMetaDeviceAuthorized] == "true"
+}
+
+func dropExternal(td TargetDescriptor) (TargetDescriptor, bool) {
+	return td, td.Labels[LabelMetaDeviceIsExternal] != "true"
+}
+
+func dropExpired(td TargetDescriptor) (TargetDescriptor, bool) {
+	if td.Labels[LabelMetaDeviceKeyExpiryDisabled] == "true" {
+		return td, true
+	}
+	expires := td.Labels[LabelMetaDeviceExpiresUnix]
+	if expires == "" {
+		return td, true
+	}
+	epoch, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return td, true
+	}
+	return td, time.Unix(epoch, 0).After(time.Now())
+}
+
+func dropStaleLastSeen(after time.Duration) Stage {
+	return func(td TargetDescriptor) (TargetDescriptor, bool) {
+		lastSeen := td.Labels[LabelMetaDeviceLastSeenUnix]
+		if lastSeen == "" {
+			return td, true
+		}
+		epoch, err := strconv.ParseInt(lastSeen, 10, 64)
+		if err != nil {
+			return td, true
+		}
+		return td, time.Since(time.Unix(epoch, 0)) <= after
+	}
+}
+
+func filterIPs(td TargetDescriptor, keep func(net.IP) (net.IP, bool)) TargetDescriptor {
+	var targets []string
+	for _, t := range td.Targets {
+		ip := net.ParseIP(t)
+		if ip == nil {
+			continue
+		}
+		if kept, ok := keep(ip); ok {
+			targets = append(targets, kept.String())
+		}
+	}
+	return TargetDescriptor{Targets: targets, Labels: td.Labels}
+}
+
+func ipv4Only(td TargetDescriptor) (TargetDescriptor, bool) {
+	return filterIPs(td, func(ip net.IP) (net.IP, bool) {
+		v4 := ip.To4()
+		return v4, v4 != nil
+	}), true
+}
+
+func ipv6Only(td TargetDescriptor) (TargetDescriptor, bool) {
+	return filterIPs(td, func(ip net.IP) (net.IP, bool) {
+		return ip, ip.To4() == nil
+	}), true
+}
+
+func stripEmptyLabels(td TargetDescriptor) (TargetDescriptor, bool) {
+	return TargetDescriptor{
+		Targets: td.Targets,
+		Labels:  filterEmpty(td.Labels),
+	}, true
+}
+
+func relabel(sc StageConfig) (Stage, error) {
+	separator := sc.Separator
+	if separator == "" {
+		separator = ";"
+	}
+	pattern := sc.Regex
+	if pattern == "" {
+		pattern = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", sc.Regex, err)
+	}
+	action := sc.Action
+	if action == "" {
+		action = "replace"
+	}
+
+	return func(td TargetDescriptor) (TargetDescriptor, bool) {
+		values := make([]string, len(sc.SourceLabels))
+		for i, l := range sc.SourceLabels {
+			values[i] = td.Labels[l]
+		}
+		joined := strings.Join(values, separator)
+		match := re.FindStringSubmatchIndex(joined)
+
+		switch action {
+		case "keep":
+			return td, match != nil
+		case "drop":
+			return td, match == nil
+		case "replace":
+			if match == nil || sc.TargetLabel == "" {
+				return td, true
+			}
+			labels := make(map[string]string, len(td.Labels)+1)
+			for k, v := range td.Labels {
+				labels[k] = v
+			}
+			labels[sc.TargetLabel] = string(re.ExpandString(nil, sc.Replacement, joined, match))
+			return TargetDescriptor{Targets: td.Targets, Labels: labels}, true
+		case "labelmap":
+			labels := make(map[string]string, len(td.Labels))
+			for k, v := range td.Labels {
+				labels[k] = v
+				if mapped := re.ReplaceAllString(k, sc.Replacement); mapped != k {
+					labels[mapped] = v
+				}
+			}
+			return TargetDescriptor{Targets: td.Targets, Labels: labels}, true
+		default:
+			return td, true
+		}
+	}, nil
+}
@@ -0,0 +1,281 @@
+package tailscalesd
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func td(labels map[string]string, targets ...string) TargetDescriptor {
+	return TargetDescriptor{Targets: targets, Labels: labels}
+}
+
+func TestBuildStageActions(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name string
+		sc   StageConfig
+		in   TargetDescriptor
+		want TargetDescriptor
+		keep bool
+	}{
+		{
+			name: "keep_tag matches",
+			sc:   StageConfig{Type: "keep_tag", Tag: "server"},
+			in:   td(map[string]string{LabelMetaDeviceTag: "server"}),
+			want: td(map[string]string{LabelMetaDeviceTag: "server"}),
+			keep: true,
+		},
+		{
+			name: "keep_tag rejects",
+			sc:   StageConfig{Type: "keep_tag", Tag: "server"},
+			in:   td(map[string]string{LabelMetaDeviceTag: "desktop"}),
+			keep: false,
+		},
+		{
+			name: "drop_tag rejects",
+			sc:   StageConfig{Type: "drop_tag", Tag: "desktop"},
+			in:   td(map[string]string{LabelMetaDeviceTag: "desktop"}),
+			keep: false,
+		},
+		{
+			name: "drop_tag keeps others",
+			sc:   StageConfig{Type: "drop_tag", Tag: "desktop"},
+			in:   td(map[string]string{LabelMetaDeviceTag: "server"}),
+			want: td(map[string]string{LabelMetaDeviceTag: "server"}),
+			keep: true,
+		},
+		{
+			name: "keep_os matches",
+			sc:   StageConfig{Type: "keep_os", OS: []string{"linux", "darwin"}},
+			in:   td(map[string]string{LabelMetaDeviceOS: "linux"}),
+			want: td(map[string]string{LabelMetaDeviceOS: "linux"}),
+			keep: true,
+		},
+		{
+			name: "keep_os rejects",
+			sc:   StageConfig{Type: "keep_os", OS: []string{"linux"}},
+			in:   td(map[string]string{LabelMetaDeviceOS: "windows"}),
+			keep: false,
+		},
+		{
+			name: "drop_unauthorized rejects",
+			sc:   StageConfig{Type: "drop_unauthorized"},
+			in:   td(map[string]string{LabelMetaDeviceAuthorized: "false"}),
+			keep: false,
+		},
+		{
+			name: "drop_unauthorized keeps",
+			sc:   StageConfig{Type: "drop_unauthorized"},
+			in:   td(map[string]string{LabelMetaDeviceAuthorized: "true"}),
+			want: td(map[string]string{LabelMetaDeviceAuthorized: "true"}),
+			keep: true,
+		},
+		{
+			name: "drop_external rejects",
+			sc:   StageConfig{Type: "drop_external"},
+			in:   td(map[string]string{LabelMetaDeviceIsExternal: "true"}),
+			keep: false,
+		},
+		{
+			name: "drop_expired rejects expired",
+			sc:   StageConfig{Type: "drop_expired"},
+			in:   td(map[string]string{LabelMetaDeviceExpiresUnix: strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)}),
+			keep: false,
+		},
+		{
+			name: "drop_expired keeps future expiry",
+			sc:   StageConfig{Type: "drop_expired"},
+			in: td(map[string]string{
+				LabelMetaDeviceExpiresUnix: strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+			}),
+			want: td(map[string]string{
+				LabelMetaDeviceExpiresUnix: strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+			}),
+			keep: true,
+		},
+		{
+			name: "drop_expired keeps key-expiry-disabled",
+			sc:   StageConfig{Type: "drop_expired"},
+			in: td(map[string]string{
+				LabelMetaDeviceKeyExpiryDisabled: "true",
+				LabelMetaDeviceExpiresUnix:       strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+			}),
+			want: td(map[string]string{
+				LabelMetaDeviceKeyExpiryDisabled: "true",
+				LabelMetaDeviceExpiresUnix:       strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+			}),
+			keep: true,
+		},
+		{
+			name: "drop_stale_last_seen rejects stale",
+			sc:   StageConfig{Type: "drop_stale_last_seen", After: time.Hour},
+			in: td(map[string]string{
+				LabelMetaDeviceLastSeenUnix: strconv.FormatInt(now.Add(-2*time.Hour).Unix(), 10),
+			}),
+			keep: false,
+		},
+		{
+			name: "drop_stale_last_seen keeps recent",
+			sc:   StageConfig{Type: "drop_stale_last_seen", After: time.Hour},
+			in: td(map[string]string{
+				LabelMetaDeviceLastSeenUnix: strconv.FormatInt(now.Add(-time.Minute).Unix(), 10),
+			}),
+			want: td(map[string]string{
+				LabelMetaDeviceLastSeenUnix: strconv.FormatInt(now.Add(-time.Minute).Unix(), 10),
+			}),
+			keep: true,
+		},
+		{
+			name: "ipv4_only filters out v6",
+			sc:   StageConfig{Type: "ipv4_only"},
+			in:   td(nil, "100.64.0.1", "fd7a:115c:a1e0::1"),
+			want: td(nil, "100.64.0.1"),
+			keep: true,
+		},
+		{
+			name: "ipv6_only filters out v4",
+			sc:   StageConfig{Type: "ipv6_only"},
+			in:   td(nil, "100.64.0.1", "fd7a:115c:a1e0::1"),
+			want: td(nil, "fd7a:115c:a1e0::1"),
+			keep: true,
+		},
+		{
+			name: "strip_empty_labels removes blanks",
+			sc:   StageConfig{Type: "strip_empty_labels"},
+			in:   td(map[string]string{"a": "1", "b": ""}),
+			want: td(map[string]string{"a": "1"}),
+			keep: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stage, err := buildStage(c.sc)
+			if err != nil {
+				t.Fatalf("buildStage: %v", err)
+			}
+			got, ok := stage(c.in)
+			if ok != c.keep {
+				t.Fatalf("keep = %v, want %v", ok, c.keep)
+			}
+			if !ok {
+				return
+			}
+			if !targetsEqual(got.Targets, c.want.Targets) {
+				t.Errorf("Targets = %v, want %v", got.Targets, c.want.Targets)
+			}
+			if !labelsEqual(got.Labels, c.want.Labels) {
+				t.Errorf("Labels = %v, want %v", got.Labels, c.want.Labels)
+			}
+		})
+	}
+}
+
+func TestBuildStageRelabelActions(t *testing.T) {
+	cases := []struct {
+		name string
+		sc   StageConfig
+		in   TargetDescriptor
+		want TargetDescriptor
+		keep bool
+	}{
+		{
+			name: "replace sets target label from capture group",
+			sc: StageConfig{
+				Type:         "relabel",
+				SourceLabels: []string{LabelMetaDeviceTag},
+				Regex:        "tag:([a-z-]+)",
+				TargetLabel:  "role",
+				Replacement:  "${1}",
+			},
+			in:   td(map[string]string{LabelMetaDeviceTag: "tag:node-exporter"}),
+			want: td(map[string]string{LabelMetaDeviceTag: "tag:node-exporter", "role": "node-exporter"}),
+			keep: true,
+		},
+		{
+			name: "keep drops non-matching",
+			sc: StageConfig{
+				Type:         "relabel",
+				Action:       "keep",
+				SourceLabels: []string{LabelMetaDeviceOS},
+				Regex:        "linux",
+			},
+			in:   td(map[string]string{LabelMetaDeviceOS: "windows"}),
+			keep: false,
+		},
+		{
+			name: "drop removes matching",
+			sc: StageConfig{
+				Type:         "relabel",
+				Action:       "drop",
+				SourceLabels: []string{LabelMetaDeviceOS},
+				Regex:        "windows",
+			},
+			in:   td(map[string]string{LabelMetaDeviceOS: "windows"}),
+			keep: false,
+		},
+		{
+			name: "labelmap copies under a new name",
+			sc: StageConfig{
+				Type:        "relabel",
+				Action:      "labelmap",
+				Regex:       "^__meta_tailscale_device_os$",
+				Replacement: "os",
+			},
+			in:   td(map[string]string{LabelMetaDeviceOS: "linux"}),
+			want: td(map[string]string{LabelMetaDeviceOS: "linux", "os": "linux"}),
+			keep: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stage, err := buildStage(c.sc)
+			if err != nil {
+				t.Fatalf("buildStage: %v", err)
+			}
+			got, ok := stage(c.in)
+			if ok != c.keep {
+				t.Fatalf("keep = %v, want %v", ok, c.keep)
+			}
+			if !ok {
+				return
+			}
+			if !labelsEqual(got.Labels, c.want.Labels) {
+				t.Errorf("Labels = %v, want %v", got.Labels, c.want.Labels)
+			}
+		})
+	}
+}
+
+func TestBuildStageUnknownType(t *testing.T) {
+	if _, err := buildStage(StageConfig{Type: "nonsense"}); err == nil {
+		t.Fatal("expected an error for an unknown stage type")
+	}
+}
+
+func targetsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
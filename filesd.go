@@ -0,0 +1,89 @@
+package tailscalesd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DiscoverFunc produces the current, already-filtered set of targets to
+// write to a file_sd_configs file, e.g. AggregateHandler.Discover.
+type DiscoverFunc func(ctx context.Context) []TargetDescriptor
+
+// FileWriter periodically writes Discover's targets to Path, for
+// consumption by Prometheus's file_sd_configs. This is useful where
+// Prometheus can't reach an HTTP SD endpoint at all (air-gapped scrapers,
+// sidecar-only setups), or where tailscalesd is run as a short-lived cron
+// job instead of a long-running server.
+type FileWriter struct {
+	Path     string
+	Source   string
+	Discover DiscoverFunc
+
+	// Interval is how often to poll and rewrite Path.
+	Interval time.Duration
+	// Jitter randomizes each Interval by up to this duration, to avoid
+	// many tailscalesd instances writing in lockstep.
+	Jitter time.Duration
+}
+
+// WriteOnce discovers targets and atomically writes them to w.Path: it
+// writes to a temp file in the same directory, then renames over Path, so
+// Prometheus never observes a partially-written file.
+func (w *FileWriter) WriteOnce(ctx context.Context) error {
+	scrapeRequestsTotal.WithLabelValues(w.Source).Inc()
+	targets := w.Discover(ctx)
+	if targets == nil {
+		targets = []TargetDescriptor{}
+	}
+	targetsReturned.WithLabelValues(w.Source).Set(float64(len(targets)))
+
+	dir := filepath.Dir(w.Path)
+	tmp, err := os.CreateTemp(dir, ".tailscalesd-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed creating temp file in %q: %w", dir, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once the rename below succeeds.
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(targets); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed encoding targets: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed closing temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), w.Path); err != nil {
+		return fmt.Errorf("failed renaming temp file to %q: %w", w.Path, err)
+	}
+	return nil
+}
+
+// Run calls WriteOnce immediately, then every Interval (plus up to Jitter)
+// until ctx is canceled. Errors from individual writes are logged, not
+// returned, so a single failed poll doesn't stop future ones.
+func (w *FileWriter) Run(ctx context.Context) error {
+	if err := w.WriteOnce(ctx); err != nil {
+		log.Printf("file_sd: failed writing %q: %v", w.Path, err)
+	}
+	for {
+		wait := w.Interval
+		if w.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(w.Jitter)))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+			if err := w.WriteOnce(ctx); err != nil {
+				log.Printf("file_sd: failed writing %q: %v", w.Path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package tailscalesd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// LabelMetaAPILocal is the value of LabelMetaAPI reported by LocalClient.
+const LabelMetaAPILocal = "localhost"
+
+// LocalClient discovers Devices using the local machine's own Tailscale
+// client, via `tailscale status --json`. It reports only what that command
+// exposes about the local tailnet's peers, which is a strict subset of what
+// the public API knows.
+type LocalClient struct {
+	// tailscale is the path to, or name of, the tailscale CLI binary.
+	tailscale string
+}
+
+// NewLocalClient returns a Client which discovers devices using the local
+// Tailscale client.
+func NewLocalClient() *LocalClient {
+	return &LocalClient{tailscale: "tailscale"}
+}
+
+// peerStatus is the subset of `tailscale status --json`'s per-peer schema
+// which this package cares about.
+type peerStatus struct {
+	ID                string
+	PublicKey         string
+	HostName          string
+	DNSName           string
+	OS                string
+	TailscaleIPs      []string
+	Tags              []string
+	Created           time.Time
+	LastSeen          time.Time
+	KeyExpiry         time.Time
+	KeyExpiryDisabled bool
+	Active            bool
+	CurAddr           string
+	Relay             string
+}
+
+type statusResponse struct {
+	Self *peerStatus
+	Peer map[string]*peerStatus
+}
+
+// Devices implements Client.
+func (l *LocalClient) Devices(ctx context.Context) ([]Device, error) {
+	cmd := exec.CommandContext(ctx, l.tailscale, "status", "--json")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed running %q: %w", l.tailscale, err)
+	}
+
+	var status statusResponse
+	if err := json.Unmarshal(out.Bytes(), &status); err != nil {
+		return nil, fmt.Errorf("failed parsing tailscale status: %w", err)
+	}
+
+	var devices []Device
+	if status.Self != nil {
+		devices = append(devices, peerToDevice(status.Self))
+	}
+	for _, peer := range status.Peer {
+		devices = append(devices, peerToDevice(peer))
+	}
+	return devices, nil
+}
+
+func peerToDevice(p *peerStatus) Device {
+	var endpoints []string
+	if p.CurAddr != "" {
+		endpoints = []string{p.CurAddr}
+	}
+	return Device{
+		API: LabelMetaAPILocal,
+		// Authorized is always true for peers visible via the local API; an
+		// unauthorized device wouldn't appear in `tailscale status` at all.
+		Authorized:        true,
+		ID:                p.ID,
+		Hostname:          p.HostName,
+		Name:              p.DNSName,
+		OS:                p.OS,
+		Tags:              p.Tags,
+		Addresses:         p.TailscaleIPs,
+		Created:           apiTime{p.Created},
+		LastSeen:          apiTime{p.LastSeen},
+		Expires:           apiTime{p.KeyExpiry},
+		KeyExpiryDisabled: p.KeyExpiryDisabled,
+		NodeKey:           p.PublicKey,
+		// ClientConnectivity is only partially known locally: `tailscale
+		// status --json` reports a peer's current relay and address, but not
+		// DERP latencies or NAT mapping behavior.
+		ClientConnectivity: ClientConnectivity{
+			DERP:      p.Relay,
+			Endpoints: endpoints,
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package tailscalesd
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scrapeRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tailscalesd_scrape_requests_total",
+		Help: "Total number of discovery requests served (HTTP SD requests and file_sd writes), by source.",
+	}, []string{"source"})
+
+	upstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tailscalesd_upstream_requests_total",
+		Help: "Total number of requests made to an upstream Tailscale API, by source and result (ok, stale, error).",
+	}, []string{"source", "result"})
+
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tailscalesd_upstream_request_duration_seconds",
+		Help:    "Latency of requests to an upstream Tailscale API, by source.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"source"})
+
+	targetsReturned = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tailscalesd_targets_returned",
+		Help: "Number of targets returned in the most recent scrape, by source.",
+	}, []string{"source"})
+
+	staleResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tailscalesd_stale_responses_total",
+		Help: "Total number of times a source served potentially stale results instead of failing.",
+	}, []string{"source"})
+
+	cacheAgeSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tailscalesd_cache_age_seconds",
+		Help: "Age of the most recently cached successful upstream response, by source.",
+	}, []string{"source"})
+)
+
+// instrumentedDevices calls client.Devices, recording upstream request
+// latency under source, and upstream request count for a successful call.
+// client is expected to be the raw, uncached Client an eventual
+// CachingClient wraps, which never returns ErrStaleResults itself; callers
+// that can end up serving stale or failed results are responsible for
+// recording those outcomes themselves, exactly once, once they know which
+// one actually happened.
+func instrumentedDevices(ctx context.Context, source string, client Client) ([]Device, error) {
+	start := time.Now()
+	devices, err := client.Devices(ctx)
+	upstreamRequestDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		upstreamRequestsTotal.WithLabelValues(source, "ok").Inc()
+	}
+	return devices, err
+}
@@ -0,0 +1,129 @@
+package tailscalesd
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// LabelMetaPortName is the name given to the port a target was expanded for,
+// as configured on the matching PortRule.
+const LabelMetaPortName = "__meta_tailscale_port_name"
+
+// LabelMetricsPath is the standard Prometheus label used to override the
+// path scraped on a target, e.g. "/metrics" or "/actuator/prometheus".
+const LabelMetricsPath = "__metrics_path__"
+
+// PortsConfig maps devices to one or more target ports, so Prometheus
+// receives ready host:port targets instead of bare addresses. This mirrors
+// the annotation-driven exposure pattern used by the Tailscale k8s-operator
+// (tailscale.com/expose), applied to Prometheus SD instead.
+type PortsConfig struct {
+	// Rules are evaluated in order; the first Rule matching a device wins.
+	Rules []PortRule `yaml:"rules"`
+
+	// DefaultPort is used for devices matching no Rule. Zero means such
+	// devices are emitted unchanged, as bare addresses.
+	DefaultPort int `yaml:"default_port,omitempty"`
+}
+
+// PortRule matches devices by ACL tag, hostname regex, or OS, and assigns
+// them one or more ports.
+type PortRule struct {
+	// Tag, if set, must equal the target's ACL tag label exactly, e.g.
+	// "tag:node-exporter".
+	Tag string `yaml:"tag,omitempty"`
+
+	// HostnameRegex, if set, must match a device's hostname.
+	HostnameRegex string `yaml:"hostname_regex,omitempty"`
+
+	// OS, if set, must equal a device's OS.
+	OS string `yaml:"os,omitempty"`
+
+	// Ports are the ports to expand a matching device's addresses into. A
+	// device is expanded into one TargetDescriptor per (address, port) pair.
+	Ports []int `yaml:"ports"`
+
+	// PortName, if set, is reported as LabelMetaPortName on expanded
+	// targets, e.g. to distinguish "node-exporter" from "cadvisor" on the
+	// same host.
+	PortName string `yaml:"port_name,omitempty"`
+
+	// MetricsPath, if set, is reported as LabelMetricsPath on expanded
+	// targets, overriding Prometheus's default scrape path.
+	MetricsPath string `yaml:"metrics_path,omitempty"`
+}
+
+func (r PortRule) matches(d Device, tag string) (bool, error) {
+	if r.Tag != "" && r.Tag != tag {
+		return false, nil
+	}
+	if r.OS != "" && r.OS != d.OS {
+		return false, nil
+	}
+	if r.HostnameRegex != "" {
+		matched, err := regexp.MatchString(r.HostnameRegex, d.Hostname)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// expandPorts expands target, built from d, into one TargetDescriptor per
+// (address, port) pair per cfg. If cfg is nil, or d matches no Rule and cfg
+// has no DefaultPort, target is returned unchanged.
+func expandPorts(target TargetDescriptor, d Device, cfg *PortsConfig) ([]TargetDescriptor, error) {
+	if cfg == nil {
+		return []TargetDescriptor{target}, nil
+	}
+
+	tag := target.Labels[LabelMetaDeviceTag]
+	var rule *PortRule
+	for i := range cfg.Rules {
+		ok, err := cfg.Rules[i].matches(d, tag)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rule = &cfg.Rules[i]
+			break
+		}
+	}
+
+	var ports []int
+	var portName, metricsPath string
+	switch {
+	case rule != nil:
+		ports = rule.Ports
+		portName = rule.PortName
+		metricsPath = rule.MetricsPath
+	case cfg.DefaultPort != 0:
+		ports = []int{cfg.DefaultPort}
+	default:
+		return []TargetDescriptor{target}, nil
+	}
+
+	expanded := make([]TargetDescriptor, 0, len(ports))
+	for _, port := range ports {
+		targets := make([]string, len(target.Targets))
+		for i, addr := range target.Targets {
+			targets[i] = net.JoinHostPort(addr, strconv.Itoa(port))
+		}
+		labels := make(map[string]string, len(target.Labels)+2)
+		for k, v := range target.Labels {
+			labels[k] = v
+		}
+		if portName != "" {
+			labels[LabelMetaPortName] = portName
+		}
+		if metricsPath != "" {
+			labels[LabelMetricsPath] = metricsPath
+		}
+		expanded = append(expanded, TargetDescriptor{Targets: targets, Labels: labels})
+	}
+	return expanded, nil
+}
@@ -0,0 +1,132 @@
+package tailscalesd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExpandPortsNilConfig(t *testing.T) {
+	target := TargetDescriptor{Targets: []string{"100.64.0.1"}}
+	got, err := expandPorts(target, Device{}, nil)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], target) {
+		t.Errorf("got %v, want target returned unchanged", got)
+	}
+}
+
+func TestExpandPortsNoMatchNoDefault(t *testing.T) {
+	target := TargetDescriptor{Targets: []string{"100.64.0.1"}}
+	cfg := &PortsConfig{Rules: []PortRule{{Tag: "node-exporter", Ports: []int{9100}}}}
+	got, err := expandPorts(target, Device{}, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], target) {
+		t.Errorf("got %v, want target returned unchanged", got)
+	}
+}
+
+func TestExpandPortsDefaultPort(t *testing.T) {
+	target := TargetDescriptor{Targets: []string{"100.64.0.1"}}
+	cfg := &PortsConfig{DefaultPort: 9100}
+	got, err := expandPorts(target, Device{}, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 || got[0].Targets[0] != "100.64.0.1:9100" {
+		t.Errorf("got %v, want a single 9100 target", got)
+	}
+}
+
+func TestExpandPortsRuleByTag(t *testing.T) {
+	target := TargetDescriptor{
+		Targets: []string{"100.64.0.1"},
+		Labels:  map[string]string{LabelMetaDeviceTag: "node-exporter"},
+	}
+	cfg := &PortsConfig{
+		Rules: []PortRule{
+			{Tag: "node-exporter", Ports: []int{9100}, PortName: "metrics"},
+		},
+	}
+	got, err := expandPorts(target, Device{}, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d targets, want 1", len(got))
+	}
+	if got[0].Targets[0] != "100.64.0.1:9100" {
+		t.Errorf("Targets = %v, want 100.64.0.1:9100", got[0].Targets)
+	}
+	if got[0].Labels[LabelMetaPortName] != "metrics" {
+		t.Errorf("PortName label = %q, want metrics", got[0].Labels[LabelMetaPortName])
+	}
+}
+
+func TestExpandPortsRuleByHostnameRegex(t *testing.T) {
+	target := TargetDescriptor{Targets: []string{"100.64.0.1"}}
+	d := Device{Hostname: "db-primary"}
+	cfg := &PortsConfig{
+		Rules: []PortRule{
+			{HostnameRegex: "^db-", Ports: []int{5432}},
+		},
+	}
+	got, err := expandPorts(target, d, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 || got[0].Targets[0] != "100.64.0.1:5432" {
+		t.Errorf("got %v, want a single 5432 target", got)
+	}
+}
+
+func TestExpandPortsMultiplePortsAndMetricsPath(t *testing.T) {
+	target := TargetDescriptor{Targets: []string{"100.64.0.1", "100.64.0.2"}}
+	cfg := &PortsConfig{
+		Rules: []PortRule{
+			{OS: "linux", Ports: []int{9100, 9323}, MetricsPath: "/actuator/prometheus"},
+		},
+	}
+	got, err := expandPorts(target, Device{OS: "linux"}, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d TargetDescriptors, want 2 (one per port)", len(got))
+	}
+	var all []string
+	for _, td := range got {
+		if td.Labels[LabelMetricsPath] != "/actuator/prometheus" {
+			t.Errorf("MetricsPath label = %q, want /actuator/prometheus", td.Labels[LabelMetricsPath])
+		}
+		all = append(all, td.Targets...)
+	}
+	sort.Strings(all)
+	want := []string{"100.64.0.1:9100", "100.64.0.1:9323", "100.64.0.2:9100", "100.64.0.2:9323"}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("expanded targets = %v, want %v", all, want)
+	}
+}
+
+func TestExpandPortsFirstMatchingRuleWins(t *testing.T) {
+	target := TargetDescriptor{
+		Targets: []string{"100.64.0.1"},
+		Labels:  map[string]string{LabelMetaDeviceTag: "node-exporter"},
+	}
+	cfg := &PortsConfig{
+		Rules: []PortRule{
+			{Tag: "node-exporter", Ports: []int{9100}},
+			{Tag: "node-exporter", Ports: []int{9999}},
+		},
+	}
+	got, err := expandPorts(target, Device{}, cfg)
+	if err != nil {
+		t.Fatalf("expandPorts: %v", err)
+	}
+	if len(got) != 1 || got[0].Targets[0] != "100.64.0.1:9100" {
+		t.Errorf("got %v, want the first matching rule's port 9100", got)
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // TargetDescriptor as Prometheus expects it. For more details, see
@@ -53,8 +56,103 @@ const (
 	// LabelMetaTailnet is the name of the Tailnet from which this target
 	// information was retrieved. Not reported when using the local API.
 	LabelMetaTailnet = "__meta_tailscale_tailnet"
+
+	// LabelMetaDeviceUser is the login name of the user who registered the
+	// target.
+	LabelMetaDeviceUser = "__meta_tailscale_device_user"
+
+	// LabelMetaDeviceCreated is when the target was registered with the
+	// Tailnet, in RFC3339 format.
+	LabelMetaDeviceCreated = "__meta_tailscale_device_created"
+
+	// LabelMetaDeviceCreatedUnix is LabelMetaDeviceCreated as a Unix epoch.
+	LabelMetaDeviceCreatedUnix = "__meta_tailscale_device_created_unix"
+
+	// LabelMetaDeviceLastSeen is when the target last communicated with the
+	// control plane, in RFC3339 format.
+	LabelMetaDeviceLastSeen = "__meta_tailscale_device_last_seen"
+
+	// LabelMetaDeviceLastSeenUnix is LabelMetaDeviceLastSeen as a Unix epoch.
+	LabelMetaDeviceLastSeenUnix = "__meta_tailscale_device_last_seen_unix"
+
+	// LabelMetaDeviceExpires is when the target's node key expires, in
+	// RFC3339 format. Omitted if the device has no expiry.
+	LabelMetaDeviceExpires = "__meta_tailscale_device_expires"
+
+	// LabelMetaDeviceExpiresUnix is LabelMetaDeviceExpires as a Unix epoch.
+	LabelMetaDeviceExpiresUnix = "__meta_tailscale_device_expires_unix"
+
+	// LabelMetaDeviceKeyExpiryDisabled is whether the target's node key is
+	// exempt from expiry.
+	LabelMetaDeviceKeyExpiryDisabled = "__meta_tailscale_device_key_expiry_disabled"
+
+	// LabelMetaDeviceUpdateAvailable is whether a newer Tailscale client
+	// version is available for the target.
+	LabelMetaDeviceUpdateAvailable = "__meta_tailscale_device_update_available"
+
+	// LabelMetaDeviceIsExternal is whether the target belongs to a shared-in
+	// node from another Tailnet.
+	LabelMetaDeviceIsExternal = "__meta_tailscale_device_is_external"
+
+	// LabelMetaDeviceMachineKey identifies the target's current Noise
+	// session.
+	LabelMetaDeviceMachineKey = "__meta_tailscale_device_machine_key"
+
+	// LabelMetaDeviceNodeKey identifies the target's Wireguard key.
+	LabelMetaDeviceNodeKey = "__meta_tailscale_device_node_key"
+
+	// LabelMetaDeviceBlocksIncomingConnections is whether the target is
+	// configured to refuse all incoming connections.
+	LabelMetaDeviceBlocksIncomingConnections = "__meta_tailscale_device_blocks_incoming_connections"
+
+	// LabelMetaDeviceDERPRegion is the DERP region the target prefers for
+	// relayed connections: a region name when reported by the public API,
+	// a region code when reported by the local API.
+	LabelMetaDeviceDERPRegion = "__meta_tailscale_device_derp_region"
+
+	// LabelMetaDeviceDERPLatencyMs is the target's last-measured round-trip
+	// latency, in milliseconds, to its preferred DERP region.
+	LabelMetaDeviceDERPLatencyMs = "__meta_tailscale_device_derp_latency_ms"
+
+	// LabelMetaDeviceEndpoints is a comma-joined list of the target's most
+	// recently reported direct-connection endpoints.
+	LabelMetaDeviceEndpoints = "__meta_tailscale_device_endpoints"
+
+	// LabelMetaDeviceMappingVaries is whether the target's NAT mapping
+	// varies by destination, making direct connections harder to establish.
+	LabelMetaDeviceMappingVaries = "__meta_tailscale_device_mapping_varies"
 )
 
+// preferredDERP returns the name of cc's preferred DERP region and the
+// last-measured latency to it, in milliseconds, by scanning DERPLatency for
+// the entry marked Preferred. DERPLatency is only reported by the public
+// API; for the local API, which only reports cc.DERP's region code, it
+// falls back to that code with no latency. Both return values are empty if
+// neither is available.
+func preferredDERP(cc ClientConnectivity) (region, latencyMs string) {
+	for name, latency := range cc.DERPLatency {
+		if !latency.Preferred {
+			continue
+		}
+		return name, strconv.FormatFloat(latency.LatencyMilliseconds, 'f', -1, 64)
+	}
+	if cc.DERP == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(cc.DERP, "-", 2)
+	return parts[len(parts)-1], ""
+}
+
+// rfc3339Unix formats t as RFC3339 and as a Unix epoch string. Both are empty
+// if t is the zero time, since the Tailscale API uses the zero time to mean
+// "not applicable" (e.g. a device with key expiry disabled).
+func rfc3339Unix(t time.Time) (rfc3339, unix string) {
+	if t.IsZero() {
+		return "", ""
+	}
+	return t.Format(time.RFC3339), strconv.FormatInt(t.Unix(), 10)
+}
+
 // filterEmpty removes entries in a map which have either an empty key or empty
 // value.
 func filterEmpty(in map[string]string) map[string]string {
@@ -71,76 +169,119 @@ func filterEmpty(in map[string]string) map[string]string {
 	return filtered
 }
 
-type filter func(TargetDescriptor) TargetDescriptor
-
-func filterIPv6Addresses(td TargetDescriptor) TargetDescriptor {
-	var targets []string
-	for _, target := range td.Targets {
-		ip := net.ParseIP(target)
-		if ip == nil {
-			// target is not a valid IP address of any version.
-			continue
-		}
-		if ipv4 := ip.To4(); ipv4 != nil {
-			targets = append(targets, ipv4.String())
-		}
-	}
-	return TargetDescriptor{
-		Targets: targets,
-		Labels:  td.Labels,
-	}
-}
-
-func filterEmptyLabels(td TargetDescriptor) TargetDescriptor {
-	return TargetDescriptor{
-		Targets: td.Targets,
-		Labels:  filterEmpty(td.Labels),
-	}
-}
-
-// translate Devices to Prometheus TargetDescriptor, filtering empty labels.
-func translate(devices []Device, filters ...filter) (found []TargetDescriptor) {
+// translate Devices to Prometheus TargetDescriptor, expanding addresses into
+// host:port targets per ports. The result is not filtered; run it through a
+// Pipeline to apply keep/drop/relabel rules.
+func translate(devices []Device, ports *PortsConfig) (found []TargetDescriptor, err error) {
 	for _, d := range devices {
+		created, createdUnix := rfc3339Unix(d.Created.Time)
+		lastSeen, lastSeenUnix := rfc3339Unix(d.LastSeen.Time)
+		expires, expiresUnix := rfc3339Unix(d.Expires.Time)
+		derpRegion, derpLatencyMs := preferredDERP(d.ClientConnectivity)
 		target := TargetDescriptor{
 			Targets: d.Addresses,
 			// All labels added here, except for tags.
 			Labels: map[string]string{
-				LabelMetaAPI:                 d.API,
-				LabelMetaDeviceAuthorized:    fmt.Sprint(d.Authorized),
-				LabelMetaDeviceClientVersion: d.ClientVersion,
-				LabelMetaDeviceHostname:      d.Hostname,
-				LabelMetaDeviceID:            d.ID,
-				LabelMetaDeviceName:          d.Name,
-				LabelMetaDeviceOS:            d.OS,
-				LabelMetaTailnet:             d.Tailnet,
+				LabelMetaAPI:                             d.API,
+				LabelMetaDeviceAuthorized:                fmt.Sprint(d.Authorized),
+				LabelMetaDeviceClientVersion:             d.ClientVersion,
+				LabelMetaDeviceHostname:                  d.Hostname,
+				LabelMetaDeviceID:                        d.ID,
+				LabelMetaDeviceName:                      d.Name,
+				LabelMetaDeviceOS:                        d.OS,
+				LabelMetaTailnet:                         d.Tailnet,
+				LabelMetaDeviceUser:                      d.User,
+				LabelMetaDeviceCreated:                   created,
+				LabelMetaDeviceCreatedUnix:               createdUnix,
+				LabelMetaDeviceLastSeen:                  lastSeen,
+				LabelMetaDeviceLastSeenUnix:              lastSeenUnix,
+				LabelMetaDeviceExpires:                   expires,
+				LabelMetaDeviceExpiresUnix:               expiresUnix,
+				LabelMetaDeviceKeyExpiryDisabled:         fmt.Sprint(d.KeyExpiryDisabled),
+				LabelMetaDeviceUpdateAvailable:           fmt.Sprint(d.UpdateAvailable),
+				LabelMetaDeviceIsExternal:                fmt.Sprint(d.IsExternal),
+				LabelMetaDeviceMachineKey:                d.MachineKey,
+				LabelMetaDeviceNodeKey:                   d.NodeKey,
+				LabelMetaDeviceBlocksIncomingConnections: fmt.Sprint(d.BlocksIncomingConnections),
+				LabelMetaDeviceDERPRegion:                derpRegion,
+				LabelMetaDeviceDERPLatencyMs:             derpLatencyMs,
+				LabelMetaDeviceEndpoints:                 strings.Join(d.ClientConnectivity.Endpoints, ","),
+				LabelMetaDeviceMappingVaries:             string(d.ClientConnectivity.MappingVariesByDestIP),
 			},
 		}
-		for _, filter := range filters {
-			target = filter(target)
-		}
-		if l := len(d.Tags); l == 0 {
-			found = append(found, target)
-			continue
+		perTag := []TargetDescriptor{target}
+		if l := len(d.Tags); l > 0 {
+			perTag = perTag[:0]
+			for _, t := range d.Tags {
+				lt := target
+				lt.Labels = make(map[string]string)
+				for k, v := range target.Labels {
+					lt.Labels[k] = v
+				}
+				lt.Labels[LabelMetaDeviceTag] = t
+				perTag = append(perTag, lt)
+			}
 		}
-		for _, t := range d.Tags {
-			lt := target
-			lt.Labels = make(map[string]string)
-			for k, v := range target.Labels {
-				lt.Labels[k] = v
+		for _, t := range perTag {
+			expanded, expandErr := expandPorts(t, d, ports)
+			if expandErr != nil {
+				return nil, expandErr
 			}
-			lt.Labels[LabelMetaDeviceTag] = t
-			found = append(found, lt)
+			found = append(found, expanded...)
 		}
 	}
-	return
+	return found, nil
+}
+
+// DiscoveryHandler serves Prometheus HTTP SD for a single Client, running
+// every discovered target through a Pipeline. The Pipeline may be swapped at
+// runtime via SetPipeline, e.g. to support reloading a config file on
+// SIGHUP.
+type DiscoveryHandler struct {
+	source   string
+	ts       Client
+	pipeline atomic.Value
+	ports    atomic.Value
+}
+
+// Client returns the Client h serves targets from, e.g. for reuse when
+// building an AggregateHandler over the same sources as a set of per-source
+// DiscoveryHandlers.
+func (h *DiscoveryHandler) Client() Client {
+	return h.ts
+}
+
+// SetPipeline atomically replaces the Pipeline applied to future requests.
+func (h *DiscoveryHandler) SetPipeline(p Pipeline) {
+	h.pipeline.Store(p)
 }
 
-type discoveryHandler struct {
-	ts      Client
-	filters []filter
+// SetPorts atomically replaces the PortsConfig applied to future requests. A
+// nil PortsConfig leaves addresses bare, unchanged.
+func (h *DiscoveryHandler) SetPorts(p *PortsConfig) {
+	h.ports.Store(p)
 }
 
-func (h *discoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *DiscoveryHandler) pipelineOrDefault() Pipeline {
+	if p, ok := h.pipeline.Load().(Pipeline); ok {
+		return p
+	}
+	return nil
+}
+
+func (h *DiscoveryHandler) portsOrDefault() *PortsConfig {
+	if p, ok := h.ports.Load().(*PortsConfig); ok {
+		return p
+	}
+	return nil
+}
+
+func (h *DiscoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scrapeRequestsTotal.WithLabelValues(h.source).Inc()
+
+	// Upstream-level metrics (requests, latency, staleness) are recorded by
+	// a CachingClient, if ts is wrapped in one; ServeHTTP only meters the
+	// scrape itself.
 	devices, err := h.ts.Devices(r.Context())
 	if err != nil {
 		if err != ErrStaleResults {
@@ -151,7 +292,23 @@ func (h *discoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Print("Serving potentially stale results")
 	}
-	targets := translate(devices, h.filters...)
+
+	raw, err := translate(devices, h.portsOrDefault())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed expanding Tailscale devices into targets: %v", err)
+		fmt.Fprintf(w, "Failed expanding Tailscale devices into targets: %v", err)
+		return
+	}
+
+	pipeline := h.pipelineOrDefault()
+	var targets []TargetDescriptor
+	for _, target := range raw {
+		if kept, ok := pipeline.Run(target); ok {
+			targets = append(targets, kept)
+		}
+	}
+	targetsReturned.WithLabelValues(h.source).Set(float64(len(targets)))
 
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(targets); err != nil {
@@ -169,11 +326,14 @@ func (h *discoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Export the Tailscale client for Service Discovery.
-func Export(ts Client) http.Handler {
-	return &discoveryHandler{
-		ts: ts,
-		// TODO(cfunkhouser): Make these filters configurable.
-		filters: []filter{filterEmptyLabels, filterIPv6Addresses},
-	}
+// Export the Tailscale client for Service Discovery, filtering and
+// relabeling discovered targets with pipeline. source labels this handler's
+// metrics and, when aggregated via AggregateHandler, its targets'
+// LabelMetaSource. Callers wanting tailscalesd's historical defaults should
+// pass DefaultPipeline. Use SetPorts on the returned handler to additionally
+// expand targets into host:port form.
+func Export(source string, ts Client, pipeline Pipeline) *DiscoveryHandler {
+	h := &DiscoveryHandler{source: source, ts: ts}
+	h.SetPipeline(pipeline)
+	return h
 }